@@ -0,0 +1,223 @@
+// Copyright 2019 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package compiler
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// CExprConfig describes how to compile and run CExpr probe programs for one
+// architecture. It mirrors the compiler invocation syz-extract uses to build
+// its own probes.
+type CExprConfig struct {
+	Arch   string
+	CC     string // compiler binary, e.g. "x86_64-linux-gnu-gcc"
+	CFlags []string
+	Fs     Fs
+
+	// Run executes the compiled probe binary at path and returns its stdout.
+	// Defaults to running it directly on the host, which only works when Arch
+	// matches the host's native arch. Cross-compiling for any other Arch
+	// requires a Run that can actually execute that arch's binaries, e.g. one
+	// that shells out to qemu-<arch> or a device/VM runner, mirroring how
+	// syz-extract runs its own probes on non-native arches.
+	Run func(path string) ([]byte, error)
+
+	// CachePath is a const-cache file persisted across runs, keyed by
+	// (arch, compiler, cflags, includes, incdirs, cexpr). Leave empty to disable
+	// caching.
+	CachePath string
+}
+
+// EvalCExprDefines compiles a tiny probe program per CExpr define gathered by
+// ExtractConsts (info.CExprDefines) and returns the resolved name -> value map,
+// to be merged into the final consts alongside the plain names in info.Consts.
+// Results are cached on disk at cfg.CachePath so that repeated runs only
+// recompile defines whose (arch, compiler, cflags, includes, incdirs, cexpr)
+// actually changed.
+func EvalCExprDefines(info *ConstInfo, cfg *CExprConfig) (map[string]uint64, error) {
+	if len(info.CExprDefines) == 0 {
+		return nil, nil
+	}
+	fs := cfg.Fs
+	if fs == nil {
+		fs = info.fs
+	}
+	fs = fsOrDefault(fs)
+	cache, err := loadCExprCache(fs, cfg.CachePath)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(info.CExprDefines))
+	for name := range info.CExprDefines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	res := make(map[string]uint64, len(names))
+	dirty := false
+	for _, name := range names {
+		cexpr := info.CExprDefines[name]
+		key := cExprCacheKey(cfg, info.Includes, info.Incdirs, cexpr)
+		if val, ok := cache[key]; ok {
+			res[name] = val
+			continue
+		}
+		val, err := evalCExpr(info, cfg, cexpr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to evaluate define %v (%v): %v", name, cexpr, err)
+		}
+		res[name] = val
+		cache[key] = val
+		dirty = true
+	}
+	if dirty && cfg.CachePath != "" {
+		if err := saveCExprCache(fs, cfg.CachePath, cache); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// evalCExpr compiles and runs a probe program that prints cexpr's value, and
+// parses the result back as a uint64.
+func evalCExpr(info *ConstInfo, cfg *CExprConfig, cexpr string) (uint64, error) {
+	cc := cfg.CC
+	if cc == "" {
+		return 0, fmt.Errorf("no compiler configured for arch %v", cfg.Arch)
+	}
+
+	dir, err := ioutil.TempDir("", "syz-cexpr")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(dir)
+
+	src := new(bytes.Buffer)
+	fmt.Fprintf(src, "// AUTOGENERATED FILE\n")
+	for _, inc := range info.Includes {
+		fmt.Fprintf(src, "#include <%v>\n", inc)
+	}
+	fmt.Fprintf(src, "#include <stdio.h>\n")
+	fmt.Fprintf(src, "int main() {\n")
+	fmt.Fprintf(src, "\tprintf(\"%%llu\\n\", (unsigned long long)(%v));\n", cexpr)
+	fmt.Fprintf(src, "\treturn 0;\n}\n")
+
+	srcFile := filepath.Join(dir, "probe.c")
+	if err := ioutil.WriteFile(srcFile, src.Bytes(), 0600); err != nil {
+		return 0, err
+	}
+
+	binFile := filepath.Join(dir, "probe")
+	args := append([]string{}, cfg.CFlags...)
+	for _, incdir := range info.Incdirs {
+		args = append(args, "-I"+incdir)
+	}
+	args = append(args, "-o", binFile, srcFile)
+	if out, err := exec.Command(cc, args...).CombinedOutput(); err != nil {
+		return 0, fmt.Errorf("compiler invocation failed: %v\n%s", err, out)
+	}
+
+	run := cfg.Run
+	if run == nil {
+		run = runProbeLocally
+	}
+	out, err := run(binFile)
+	if err != nil {
+		return 0, fmt.Errorf("probe invocation failed: %v", err)
+	}
+	val, err := strconv.ParseUint(strings.TrimSpace(string(out)), 0, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse probe output %q: %v", out, err)
+	}
+	return val, nil
+}
+
+// runProbeLocally is the default CExprConfig.Run: it executes the probe binary
+// directly on the host, which is only correct when the host's native arch
+// matches CExprConfig.Arch.
+func runProbeLocally(path string) ([]byte, error) {
+	return exec.Command(path).Output()
+}
+
+// cExprCacheKey hashes the inputs that determine a CExpr's value so they can be
+// used as a map/file key (the inputs themselves contain slices and so aren't
+// comparable). This must include everything that can change the compiled
+// result: a different compiler or flags (e.g. a different ABI) can make the
+// same cexpr evaluate to a different value even on the same arch.
+func cExprCacheKey(cfg *CExprConfig, includes, incdirs []string, cexpr string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "arch:%v\n", cfg.Arch)
+	fmt.Fprintf(h, "cc:%v\n", cfg.CC)
+	for _, flag := range cfg.CFlags {
+		fmt.Fprintf(h, "cflag:%v\n", flag)
+	}
+	for _, inc := range includes {
+		fmt.Fprintf(h, "include:%v\n", inc)
+	}
+	for _, dir := range incdirs {
+		fmt.Fprintf(h, "incdir:%v\n", dir)
+	}
+	fmt.Fprintf(h, "cexpr:%v\n", cexpr)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func loadCExprCache(fs Fs, path string) (map[string]uint64, error) {
+	cache := make(map[string]uint64)
+	if path == "" {
+		return cache, nil
+	}
+	data, err := fs.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cache, nil
+		}
+		return nil, fmt.Errorf("failed to read const-cache file: %v", err)
+	}
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		line := s.Text()
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		eq := strings.IndexByte(line, '=')
+		if eq == -1 {
+			continue
+		}
+		key := strings.TrimSpace(line[:eq])
+		val, err := strconv.ParseUint(strings.TrimSpace(line[eq+1:]), 0, 64)
+		if err != nil {
+			continue
+		}
+		cache[key] = val
+	}
+	return cache, nil
+}
+
+func saveCExprCache(fs Fs, path string, cache map[string]uint64) error {
+	var nv []nameValuePair
+	for k, v := range cache {
+		nv = append(nv, nameValuePair{k, v})
+	}
+	sort.Sort(nameValueArray(nv))
+
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "# AUTOGENERATED FILE\n")
+	for _, x := range nv {
+		fmt.Fprintf(buf, "%v = %v\n", x.name, x.val)
+	}
+	return fs.WriteFile(path, buf.Bytes(), 0600)
+}
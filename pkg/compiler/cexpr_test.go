@@ -0,0 +1,96 @@
+// Copyright 2019 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package compiler
+
+import "testing"
+
+func TestCExprCacheKeyDistinguishesInputs(t *testing.T) {
+	base := &CExprConfig{Arch: "amd64", CC: "gcc", CFlags: []string{"-m64"}}
+	baseKey := cExprCacheKey(base, []string{"linux/types.h"}, nil, "sizeof(long)")
+
+	variants := []*CExprConfig{
+		{Arch: "arm64", CC: "gcc", CFlags: []string{"-m64"}},
+		{Arch: "amd64", CC: "clang", CFlags: []string{"-m64"}},
+		{Arch: "amd64", CC: "gcc", CFlags: []string{"-m32"}},
+	}
+	for i, cfg := range variants {
+		key := cExprCacheKey(cfg, []string{"linux/types.h"}, nil, "sizeof(long)")
+		if key == baseKey {
+			t.Errorf("variant %v: expected a different cache key, got the same as base", i)
+		}
+	}
+
+	// Same inputs, but includes/incdirs/cexpr differ.
+	if key := cExprCacheKey(base, []string{"linux/other.h"}, nil, "sizeof(long)"); key == baseKey {
+		t.Error("different includes should produce a different cache key")
+	}
+	if key := cExprCacheKey(base, []string{"linux/types.h"}, []string{"/usr/include"}, "sizeof(long)"); key == baseKey {
+		t.Error("different incdirs should produce a different cache key")
+	}
+	if key := cExprCacheKey(base, []string{"linux/types.h"}, nil, "sizeof(int)"); key == baseKey {
+		t.Error("different cexpr should produce a different cache key")
+	}
+
+	// Identical inputs must produce an identical key.
+	if key := cExprCacheKey(base, []string{"linux/types.h"}, nil, "sizeof(long)"); key != baseKey {
+		t.Error("identical inputs should produce an identical cache key")
+	}
+}
+
+func TestCExprCacheRoundTrip(t *testing.T) {
+	fs := newMemFs(nil)
+	const path = "consts.cache"
+	want := map[string]uint64{"a": 1, "b": 2}
+
+	if err := saveCExprCache(fs, path, want); err != nil {
+		t.Fatalf("saveCExprCache failed: %v", err)
+	}
+	if _, ok := fs.files[path]; !ok {
+		t.Fatalf("saveCExprCache did not write through the injected Fs")
+	}
+
+	got, err := loadCExprCache(fs, path)
+	if err != nil {
+		t.Fatalf("loadCExprCache failed: %v", err)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("cache[%v] = %v, want %v", k, got[k], v)
+		}
+	}
+}
+
+func TestLoadCExprCacheMissingFile(t *testing.T) {
+	fs := newMemFs(nil)
+	cache, err := loadCExprCache(fs, "does-not-exist.cache")
+	if err != nil {
+		t.Fatalf("expected a missing cache file to be treated as empty, got error: %v", err)
+	}
+	if len(cache) != 0 {
+		t.Fatalf("expected an empty cache, got %#v", cache)
+	}
+}
+
+func TestEvalCExprUsesInjectedRun(t *testing.T) {
+	info := &ConstInfo{}
+	var ranPath string
+	cfg := &CExprConfig{
+		Arch: "arm",
+		CC:   "true",
+		Run: func(path string) ([]byte, error) {
+			ranPath = path
+			return []byte("42\n"), nil
+		},
+	}
+	val, err := evalCExpr(info, cfg, "6*7")
+	if err != nil {
+		t.Fatalf("evalCExpr failed: %v", err)
+	}
+	if val != 42 {
+		t.Fatalf("got %v, want 42", val)
+	}
+	if ranPath == "" {
+		t.Fatalf("expected the injected Run to be called with the probe binary path")
+	}
+}
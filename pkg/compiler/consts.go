@@ -7,7 +7,6 @@ import (
 	"bufio"
 	"bytes"
 	"fmt"
-	"io/ioutil"
 	"path/filepath"
 	"sort"
 	"strconv"
@@ -21,10 +20,23 @@ type ConstInfo struct {
 	Includes []string
 	Incdirs  []string
 	Defines  map[string]string
+	// CExprDefines holds defines whose value is a C expression (e.g.
+	// "sizeof(struct bar) + 4") rather than a literal or an identifier.
+	// These are not extracted like a plain named const; EvalCExprDefines
+	// resolves them to concrete values by compiling a probe program.
+	CExprDefines map[string]string
+
+	// fs is the filesystem ExtractConsts was called with. It is carried along on
+	// ConstInfo so that later stages of the const pipeline reuse the same Fs
+	// rather than falling back to the OS filesystem: EvalCExprDefines uses it for
+	// its const-cache file when CExprConfig.Fs is nil. The probe compiler itself
+	// still reads Includes/Incdirs from the OS filesystem.
+	fs Fs
 }
 
 // ExtractConsts returns list of literal constants and other info required const value extraction.
-func ExtractConsts(desc *ast.Description, eh0 ast.ErrorHandler) *ConstInfo {
+// fs is optional; pass nil to use the OS filesystem.
+func ExtractConsts(desc *ast.Description, fs Fs, eh0 ast.ErrorHandler) *ConstInfo {
 	errors := 0
 	eh := func(pos ast.Pos, msg string, args ...interface{}) {
 		errors++
@@ -36,7 +48,9 @@ func ExtractConsts(desc *ast.Description, eh0 ast.ErrorHandler) *ConstInfo {
 		}
 	}
 	info := &ConstInfo{
-		Defines: make(map[string]string),
+		Defines:      make(map[string]string),
+		CExprDefines: make(map[string]string),
+		fs:           fsOrDefault(fs),
 	}
 	includeMap := make(map[string]bool)
 	incdirMap := make(map[string]bool)
@@ -59,19 +73,22 @@ func ExtractConsts(desc *ast.Description, eh0 ast.ErrorHandler) *ConstInfo {
 			incdirMap[dir] = true
 			info.Incdirs = append(info.Incdirs, dir)
 		case *ast.Define:
-			v := fmt.Sprint(n.Value.Value)
+			name := n.Name.Name
+			if info.Defines[name] != "" || info.CExprDefines[name] != "" {
+				eh(n.Pos, "duplicate define %v", name)
+			}
 			switch {
 			case n.Value.CExpr != "":
-				v = n.Value.CExpr
+				// CExpr defines are resolved by EvalCExprDefines, not by
+				// extracting a named const, so they don't go into constMap.
+				info.CExprDefines[name] = n.Value.CExpr
 			case n.Value.Ident != "":
-				v = n.Value.Ident
+				info.Defines[name] = n.Value.Ident
+				constMap[name] = true
+			default:
+				info.Defines[name] = fmt.Sprint(n.Value.Value)
+				constMap[name] = true
 			}
-			name := n.Name.Name
-			if info.Defines[name] != "" {
-				eh(n.Pos, "duplicate define %v", name)
-			}
-			info.Defines[name] = v
-			constMap[name] = true
 		case *ast.Call:
 			if !strings.HasPrefix(n.CallName, "syz_") {
 				constMap["__NR_"+n.CallName] = true
@@ -151,11 +168,16 @@ func DeserializeConsts(data []byte, file string, eh ast.ErrorHandler) map[string
 	return consts
 }
 
-func DeserializeConstsGlob(glob string, eh ast.ErrorHandler) map[string]uint64 {
+// DeserializeConstsGlob reads all const files matched by glob and merges them into
+// a single arch -> name -> value map. Files may use the multi-arch section format
+// (see SerializeConstsMulti), so a single file can contribute values for several
+// architectures at once. fs is optional; pass nil to use the OS filesystem.
+func DeserializeConstsGlob(fs Fs, glob string, eh ast.ErrorHandler) map[string]map[string]uint64 {
+	fs = fsOrDefault(fs)
 	if eh == nil {
 		eh = ast.LoggingHandler
 	}
-	files, err := filepath.Glob(glob)
+	files, err := fs.Glob(glob)
 	if err != nil {
 		eh(ast.Pos{}, fmt.Sprintf("failed to find const files: %v", err))
 		return nil
@@ -164,31 +186,189 @@ func DeserializeConstsGlob(glob string, eh ast.ErrorHandler) map[string]uint64 {
 		eh(ast.Pos{}, fmt.Sprintf("no const files matched by glob %q", glob))
 		return nil
 	}
-	consts := make(map[string]uint64)
+	consts := make(map[string]map[string]uint64)
 	for _, f := range files {
-		data, err := ioutil.ReadFile(f)
+		data, err := fs.ReadFile(f)
 		if err != nil {
 			eh(ast.Pos{}, fmt.Sprintf("failed to read const file: %v", err))
 			return nil
 		}
-		consts1 := DeserializeConsts(data, filepath.Base(f), eh)
+		consts1 := DeserializeConstsMulti(data, filepath.Base(f), eh)
 		if consts1 == nil {
 			consts = nil
 		}
 		if consts != nil {
-			for n, v := range consts1 {
-				if old, ok := consts[n]; ok && old != v {
-					eh(ast.Pos{}, fmt.Sprintf(
-						"different values for const %q: %v vs %v", n, v, old))
-					return nil
+			for arch, archConsts := range consts1 {
+				if consts[arch] == nil {
+					consts[arch] = make(map[string]uint64)
+				}
+				for n, v := range archConsts {
+					if old, ok := consts[arch][n]; ok && old != v {
+						eh(ast.Pos{}, fmt.Sprintf(
+							"different values for const %q on %v: %v vs %v", n, arch, v, old))
+						return nil
+					}
+					consts[arch][n] = v
 				}
-				consts[n] = v
 			}
 		}
 	}
 	return consts
 }
 
+// SerializeConstsMulti serializes consts for multiple architectures into a single file.
+// Values that are identical across all archs are hoisted into a shared [common] section,
+// the rest go into per-arch sections, e.g.:
+//
+//	[common]
+//	FOO = 1
+//	[amd64]
+//	BAR = 2
+//	[arm64]
+//	BAR = 3
+func SerializeConstsMulti(archConsts map[string]map[string]uint64) []byte {
+	archs := make([]string, 0, len(archConsts))
+	for arch := range archConsts {
+		archs = append(archs, arch)
+	}
+	sort.Strings(archs)
+
+	common := make(map[string]uint64)
+	if len(archs) != 0 {
+		for name, val := range archConsts[archs[0]] {
+			isCommon := true
+			for _, arch := range archs[1:] {
+				v, ok := archConsts[arch][name]
+				if !ok || v != val {
+					isCommon = false
+					break
+				}
+			}
+			if isCommon {
+				common[name] = val
+			}
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "# AUTOGENERATED FILE\n")
+	writeConstsSection(buf, "common", common, true)
+	for _, arch := range archs {
+		archOnly := make(map[string]uint64)
+		for name, val := range archConsts[arch] {
+			if _, ok := common[name]; !ok {
+				archOnly[name] = val
+			}
+		}
+		// Always emit the arch header, even if archOnly is empty (e.g. every
+		// value for this arch turned out to be common): DeserializeConstsMulti
+		// only learns an arch exists in the file from its section header.
+		writeConstsSection(buf, arch, archOnly, false)
+	}
+	return buf.Bytes()
+}
+
+func writeConstsSection(buf *bytes.Buffer, name string, consts map[string]uint64, omitEmpty bool) {
+	if omitEmpty && len(consts) == 0 {
+		return
+	}
+	fmt.Fprintf(buf, "[%v]\n", name)
+	var nv []nameValuePair
+	for k, v := range consts {
+		nv = append(nv, nameValuePair{k, v})
+	}
+	sort.Sort(nameValueArray(nv))
+	for _, x := range nv {
+		fmt.Fprintf(buf, "%v = %v\n", x.name, x.val)
+	}
+}
+
+// DeserializeConstsMulti parses the multi-arch const file format produced by
+// SerializeConstsMulti and returns arch -> name -> value, with the [common]
+// section values merged into every arch. It rejects files where an arch section
+// redefines a name already present in [common] with a different value, since
+// that means the value is not actually common across archs.
+func DeserializeConstsMulti(data []byte, file string, eh ast.ErrorHandler) map[string]map[string]uint64 {
+	pos := ast.Pos{
+		File: file,
+		Line: 1,
+	}
+	ok := true
+	section := ""
+	common := make(map[string]uint64)
+	archConsts := make(map[string]map[string]uint64)
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for ; s.Scan(); pos.Line++ {
+		line := s.Text()
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if line[0] == '[' {
+			if line[len(line)-1] != ']' {
+				eh(pos, "expect ']'")
+				ok = false
+				continue
+			}
+			section = line[1 : len(line)-1]
+			if section != "common" && archConsts[section] == nil {
+				archConsts[section] = make(map[string]uint64)
+			}
+			continue
+		}
+		if section == "" {
+			eh(pos, "const value outside of a section")
+			ok = false
+			continue
+		}
+		eq := strings.IndexByte(line, '=')
+		if eq == -1 {
+			eh(pos, "expect '='")
+			ok = false
+			continue
+		}
+		name := strings.TrimSpace(line[:eq])
+		val, err := strconv.ParseUint(strings.TrimSpace(line[eq+1:]), 0, 64)
+		if err != nil {
+			eh(pos, fmt.Sprintf("failed to parse int: %v", err))
+			ok = false
+			continue
+		}
+		if section == "common" {
+			if _, dup := common[name]; dup {
+				eh(pos, fmt.Sprintf("duplicate const %q in [common]", name))
+				ok = false
+				continue
+			}
+			common[name] = val
+		} else {
+			if _, dup := archConsts[section][name]; dup {
+				eh(pos, fmt.Sprintf("duplicate const %q in [%v]", name, section))
+				ok = false
+				continue
+			}
+			archConsts[section][name] = val
+		}
+	}
+	if err := s.Err(); err != nil {
+		eh(pos, fmt.Sprintf("failed to parse: %v", err))
+		ok = false
+	}
+	if !ok {
+		return nil
+	}
+	for arch, consts := range archConsts {
+		for name, val := range common {
+			if old, dup := consts[name]; dup && old != val {
+				eh(pos, fmt.Sprintf(
+					"const %q in [%v] (%v) conflicts with [common] value (%v)", name, arch, old, val))
+				return nil
+			}
+			consts[name] = val
+		}
+	}
+	return archConsts
+}
+
 type nameValuePair struct {
 	name string
 	val  uint64
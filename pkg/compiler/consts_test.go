@@ -0,0 +1,98 @@
+// Copyright 2019 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package compiler
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/google/syzkaller/pkg/ast"
+)
+
+func TestSerializeConstsMultiRoundTrip(t *testing.T) {
+	tests := []map[string]map[string]uint64{
+		{
+			"amd64": {"FOO": 1, "BAR": 2, "SHARED": 10},
+			"arm64": {"FOO": 1, "BAZ": 3, "SHARED": 10},
+		},
+		// Every value happens to be common: regression test for a bug where
+		// an arch whose section ended up empty (everything hoisted into
+		// [common]) was dropped entirely on deserialization.
+		{
+			"amd64": {"FOO": 1},
+			"arm64": {"FOO": 1},
+		},
+		// A single arch: the common-detection loop has nothing to compare
+		// against, so everything should be treated as common.
+		{
+			"amd64": {"FOO": 1, "BAR": 2},
+		},
+	}
+	for i, archConsts := range tests {
+		data := SerializeConstsMulti(archConsts)
+		got := DeserializeConstsMulti(data, "test.const", failOnError(t))
+		if !reflect.DeepEqual(got, archConsts) {
+			t.Errorf("case %v: got %#v, want %#v\ndata:\n%s", i, got, archConsts, data)
+		}
+	}
+}
+
+func TestDeserializeConstsMultiRejectsBadCommon(t *testing.T) {
+	data := []byte("# AUTOGENERATED FILE\n" +
+		"[common]\n" +
+		"FOO = 1\n" +
+		"[amd64]\n" +
+		"FOO = 2\n")
+	var errs []string
+	got := DeserializeConstsMulti(data, "test.const", func(pos ast.Pos, msg string) {
+		errs = append(errs, msg)
+	})
+	if got != nil {
+		t.Fatalf("expected nil result for conflicting common/arch value, got %#v", got)
+	}
+	if len(errs) == 0 {
+		t.Fatalf("expected an error to be reported")
+	}
+}
+
+func TestDeserializeConstsMultiMalformedSection(t *testing.T) {
+	data := []byte("# AUTOGENERATED FILE\n" +
+		"[amd64\n" +
+		"FOO = 1\n")
+	var errs []string
+	got := DeserializeConstsMulti(data, "test.const", func(pos ast.Pos, msg string) {
+		errs = append(errs, msg)
+	})
+	if got != nil {
+		t.Fatalf("expected nil result for malformed section header, got %#v", got)
+	}
+	if len(errs) == 0 {
+		t.Fatalf("expected an error to be reported")
+	}
+}
+
+func TestDeserializeConstsMultiDuplicate(t *testing.T) {
+	data := []byte("# AUTOGENERATED FILE\n" +
+		"[amd64]\n" +
+		"FOO = 1\n" +
+		"FOO = 2\n")
+	var errs []string
+	got := DeserializeConstsMulti(data, "test.const", func(pos ast.Pos, msg string) {
+		errs = append(errs, msg)
+	})
+	if got != nil {
+		t.Fatalf("expected nil result for duplicate const, got %#v", got)
+	}
+	if len(errs) == 0 {
+		t.Fatalf("expected an error to be reported")
+	}
+}
+
+// failOnError adapts *testing.T into an ast.ErrorHandler, failing the test on
+// any reported error.
+func failOnError(t *testing.T) ast.ErrorHandler {
+	return func(pos ast.Pos, msg string) {
+		t.Fatalf("unexpected error: %v: %v", pos, msg)
+	}
+}
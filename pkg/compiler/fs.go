@@ -0,0 +1,47 @@
+// Copyright 2019 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package compiler
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Fs is a small filesystem abstraction used by the const extraction pipeline.
+// It lets callers that don't have a real filesystem at hand (a syz-manager
+// working off uploaded descriptions, or hermetic tests) drive
+// ExtractConsts/DeserializeConstsGlob, and the CExpr const-cache, against an
+// in-memory implementation instead of the OS filesystem.
+//
+// Fs only has the methods this package actually calls. If a future change adds
+// a reader of included *.txt files (or anything else that needs to open a file
+// as a stream), add an Open method here then, rather than speculatively ahead
+// of a caller.
+type Fs interface {
+	ReadFile(name string) ([]byte, error)
+	WriteFile(name string, data []byte, perm os.FileMode) error
+	Glob(pattern string) ([]string, error)
+}
+
+// OSFs is the default Fs, backed by the real filesystem. Passing a nil Fs to
+// any function in this package is equivalent to passing OSFs.
+var OSFs Fs = osFs{}
+
+type osFs struct{}
+
+func (osFs) ReadFile(name string) ([]byte, error) { return ioutil.ReadFile(name) }
+
+func (osFs) WriteFile(name string, data []byte, perm os.FileMode) error {
+	return ioutil.WriteFile(name, data, perm)
+}
+
+func (osFs) Glob(pattern string) ([]string, error) { return filepath.Glob(pattern) }
+
+func fsOrDefault(fs Fs) Fs {
+	if fs == nil {
+		return OSFs
+	}
+	return fs
+}
@@ -0,0 +1,83 @@
+// Copyright 2019 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package compiler
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// memFs is an in-memory Fs used by tests to exercise the hermetic paths the
+// Fs abstraction was added for, without touching the real filesystem.
+type memFs struct {
+	files map[string][]byte
+}
+
+func newMemFs(files map[string][]byte) *memFs {
+	return &memFs{files: files}
+}
+
+var _ Fs = (*memFs)(nil)
+
+func (fs *memFs) ReadFile(name string) ([]byte, error) {
+	data, ok := fs.files[name]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	return data, nil
+}
+
+func (fs *memFs) WriteFile(name string, data []byte, perm os.FileMode) error {
+	if fs.files == nil {
+		fs.files = make(map[string][]byte)
+	}
+	fs.files[name] = append([]byte{}, data...)
+	return nil
+}
+
+func (fs *memFs) Glob(pattern string) ([]string, error) {
+	var matches []string
+	for name := range fs.files {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			matches = append(matches, name)
+		}
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
+
+func TestFsOrDefault(t *testing.T) {
+	if fsOrDefault(nil) != OSFs {
+		t.Fatalf("fsOrDefault(nil) should return OSFs")
+	}
+	fs := newMemFs(nil)
+	if fsOrDefault(fs) != Fs(fs) {
+		t.Fatalf("fsOrDefault should return the given Fs unchanged")
+	}
+}
+
+func TestDeserializeConstsGlobMemFs(t *testing.T) {
+	amd64 := map[string]map[string]uint64{
+		"amd64": {"FOO": 1, "BAR": 2},
+	}
+	arm64 := map[string]map[string]uint64{
+		"arm64": {"FOO": 1, "BAR": 3},
+	}
+	fs := newMemFs(map[string][]byte{
+		"a_amd64.const": SerializeConstsMulti(amd64),
+		"b_arm64.const": SerializeConstsMulti(arm64),
+	})
+
+	got := DeserializeConstsGlob(fs, "*.const", nil)
+	want := map[string]map[string]uint64{
+		"amd64": {"FOO": 1, "BAR": 2},
+		"arm64": {"FOO": 1, "BAR": 3},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %#v, want %#v", got, want)
+	}
+}
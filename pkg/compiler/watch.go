@@ -0,0 +1,220 @@
+// Copyright 2019 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package compiler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/google/syzkaller/pkg/ast"
+)
+
+// watchDebounce is how long Watch waits after the last filesystem event in a
+// burst before processing the batch, so that e.g. an editor's save-via-rename
+// doesn't trigger two runs for one edit.
+const watchDebounce = 200 * time.Millisecond
+
+// Extractor refreshes the *.const data for one description file on one arch
+// and returns the resulting name -> value consts. It's only invoked when the
+// file's ConstInfo actually changed, and is expected to mirror what syz-extract
+// does for a single (file, arch) pair.
+type Extractor func(file, arch string, info *ConstInfo) (map[string]uint64, error)
+
+// WatchConfig configures Watch.
+type WatchConfig struct {
+	// Root is the sys/ directory watched recursively for *.txt changes.
+	Root string
+	// Archs are extracted for every changed description file.
+	Archs []string
+	Fs    Fs
+
+	Extract Extractor
+	// ConstPath optionally returns the path of the existing *.const file for
+	// file/arch, so Watch can log a diff against the values it's replacing.
+	ConstPath func(file, arch string) string
+
+	// Debounce defaults to 200ms.
+	Debounce time.Duration
+	// Logf defaults to printing to stderr.
+	Logf func(msg string, args ...interface{})
+}
+
+// Watch watches cfg.Root for changes to *.txt description files and re-runs
+// ExtractConsts plus cfg.Extract for each changed file, but only for files
+// whose Consts/Includes/Incdirs/Defines actually changed (compared via a hash
+// of the previous ConstInfo), turning description editing into a sub-second
+// loop instead of a full `make extract` run. It blocks until stop is closed.
+func Watch(cfg *WatchConfig, stop <-chan struct{}) error {
+	fs := fsOrDefault(cfg.Fs)
+	debounce := cfg.Debounce
+	if debounce == 0 {
+		debounce = watchDebounce
+	}
+	logf := cfg.Logf
+	if logf == nil {
+		logf = func(msg string, args ...interface{}) {
+			fmt.Fprintf(os.Stderr, msg+"\n", args...)
+		}
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to create watcher: %v", err)
+	}
+	defer watcher.Close()
+	if err := addRecursive(watcher, cfg.Root); err != nil {
+		return err
+	}
+
+	hashes := make(map[string]string)
+	pending := make(map[string]bool)
+	timer := time.NewTimer(0)
+	if !timer.Stop() {
+		<-timer.C
+	}
+
+	for {
+		select {
+		case <-stop:
+			return nil
+		case err := <-watcher.Errors:
+			logf("watch: %v", err)
+		case ev := <-watcher.Events:
+			if info, err := os.Stat(ev.Name); err == nil && info.IsDir() {
+				if ev.Op&(fsnotify.Create) != 0 {
+					addRecursive(watcher, ev.Name)
+				}
+				continue
+			}
+			if !strings.HasSuffix(ev.Name, ".txt") {
+				continue
+			}
+			pending[ev.Name] = true
+			timer.Reset(debounce)
+		case <-timer.C:
+			for file := range pending {
+				processWatchedFile(cfg, fs, file, hashes, logf)
+			}
+			pending = make(map[string]bool)
+		}
+	}
+}
+
+func addRecursive(watcher *fsnotify.Watcher, root string) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return watcher.Add(path)
+		}
+		return nil
+	})
+}
+
+func processWatchedFile(cfg *WatchConfig, fs Fs, file string, hashes map[string]string, logf func(string, ...interface{})) {
+	data, err := fs.ReadFile(file)
+	if err != nil {
+		logf("watch: failed to read %v: %v", file, err)
+		return
+	}
+	errors := 0
+	eh := func(pos ast.Pos, msg string) {
+		errors++
+		logf("%v: %v", pos, msg)
+	}
+	desc := ast.Parse(data, file, eh)
+	if desc == nil || errors != 0 {
+		return
+	}
+	info := ExtractConsts(desc, fs, eh)
+	if info == nil {
+		return
+	}
+	hash := constInfoHash(info)
+	if hashes[file] == hash {
+		return
+	}
+	hashes[file] = hash
+
+	for _, arch := range cfg.Archs {
+		var old map[string]uint64
+		if cfg.ConstPath != nil {
+			if path := cfg.ConstPath(file, arch); path != "" {
+				if data, err := fs.ReadFile(path); err == nil {
+					old = DeserializeConstsMulti(data, path, eh)[arch]
+				}
+			}
+		}
+		consts, err := cfg.Extract(file, arch, info)
+		if err != nil {
+			logf("watch: failed to extract %v/%v: %v", file, arch, err)
+			continue
+		}
+		logConstsDiff(logf, file, arch, old, consts)
+	}
+}
+
+func logConstsDiff(logf func(string, ...interface{}), file, arch string, oldConsts, newConsts map[string]uint64) {
+	names := make(map[string]bool)
+	for name := range oldConsts {
+		names[name] = true
+	}
+	for name := range newConsts {
+		names[name] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	for _, name := range sorted {
+		oldVal, hadOld := oldConsts[name]
+		newVal, hasNew := newConsts[name]
+		switch {
+		case !hadOld && hasNew:
+			logf("%v/%v: %v = %v (new)", file, arch, name, newVal)
+		case hadOld && !hasNew:
+			logf("%v/%v: %v removed (was %v)", file, arch, name, oldVal)
+		case hadOld && hasNew && oldVal != newVal:
+			logf("%v/%v: %v changed: %v -> %v", file, arch, name, oldVal, newVal)
+		}
+	}
+}
+
+// constInfoHash hashes the parts of ConstInfo that determine extraction output,
+// so Watch can skip re-extracting files whose relevant content didn't change.
+func constInfoHash(info *ConstInfo) string {
+	h := sha256.New()
+	consts := append([]string{}, info.Consts...)
+	sort.Strings(consts)
+	for _, c := range consts {
+		fmt.Fprintf(h, "const:%v\n", c)
+	}
+	for _, inc := range info.Includes {
+		fmt.Fprintf(h, "include:%v\n", inc)
+	}
+	for _, dir := range info.Incdirs {
+		fmt.Fprintf(h, "incdir:%v\n", dir)
+	}
+	defines := make([]string, 0, len(info.Defines)+len(info.CExprDefines))
+	for name, val := range info.Defines {
+		defines = append(defines, name+"="+val)
+	}
+	for name, val := range info.CExprDefines {
+		defines = append(defines, name+"=cexpr:"+val)
+	}
+	sort.Strings(defines)
+	for _, d := range defines {
+		fmt.Fprintf(h, "define:%v\n", d)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,134 @@
+// Copyright 2019 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package compiler
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestConstInfoHashStableAndSensitive(t *testing.T) {
+	base := &ConstInfo{
+		Consts:       []string{"B", "A"},
+		Includes:     []string{"linux/types.h"},
+		Incdirs:      []string{"/usr/include"},
+		Defines:      map[string]string{"FOO": "1"},
+		CExprDefines: map[string]string{"BAR": "sizeof(long)"},
+	}
+	// The order of Consts and of map iteration shouldn't matter: same logical content.
+	same := &ConstInfo{
+		Consts:       []string{"A", "B"},
+		Includes:     []string{"linux/types.h"},
+		Incdirs:      []string{"/usr/include"},
+		Defines:      map[string]string{"FOO": "1"},
+		CExprDefines: map[string]string{"BAR": "sizeof(long)"},
+	}
+	if constInfoHash(base) != constInfoHash(same) {
+		t.Fatalf("expected hash to be order-independent")
+	}
+
+	variants := []*ConstInfo{
+		{Consts: []string{"A", "B", "C"}, Includes: base.Includes, Incdirs: base.Incdirs, Defines: base.Defines, CExprDefines: base.CExprDefines},
+		{Consts: base.Consts, Includes: []string{"linux/other.h"}, Incdirs: base.Incdirs, Defines: base.Defines, CExprDefines: base.CExprDefines},
+		{Consts: base.Consts, Includes: base.Includes, Incdirs: []string{"/opt/include"}, Defines: base.Defines, CExprDefines: base.CExprDefines},
+		{Consts: base.Consts, Includes: base.Includes, Incdirs: base.Incdirs, Defines: map[string]string{"FOO": "2"}, CExprDefines: base.CExprDefines},
+		{Consts: base.Consts, Includes: base.Includes, Incdirs: base.Incdirs, Defines: base.Defines, CExprDefines: map[string]string{"BAR": "sizeof(int)"}},
+	}
+	baseHash := constInfoHash(base)
+	for i, v := range variants {
+		if constInfoHash(v) == baseHash {
+			t.Errorf("variant %v: expected a different hash than base", i)
+		}
+	}
+}
+
+func TestLogConstsDiffReportsChanges(t *testing.T) {
+	var msgs []string
+	logf := func(format string, args ...interface{}) {
+		msgs = append(msgs, format)
+	}
+	old := map[string]uint64{"FOO": 1, "BAR": 2, "GONE": 3}
+	newConsts := map[string]uint64{"FOO": 1, "BAR": 5, "NEW": 4}
+	logConstsDiff(logf, "sys/linux/x.txt", "amd64", old, newConsts)
+
+	if len(msgs) != 3 {
+		t.Fatalf("expected 3 diff lines (changed, removed, new), got %v: %v", len(msgs), msgs)
+	}
+}
+
+func TestProcessWatchedFileSkipsUnchangedContent(t *testing.T) {
+	const file = "sys/linux/foo.txt"
+	fs := newMemFs(map[string][]byte{
+		file: []byte("include <linux/types.h>\n\ndefine FOO 1\n"),
+	})
+	var extractCalls int
+	cfg := &WatchConfig{
+		Archs: []string{"amd64"},
+		Fs:    fs,
+		Extract: func(file, arch string, info *ConstInfo) (map[string]uint64, error) {
+			extractCalls++
+			return map[string]uint64{"FOO": 1}, nil
+		},
+	}
+	noopLogf := func(string, ...interface{}) {}
+	hashes := make(map[string]string)
+
+	processWatchedFile(cfg, fs, file, hashes, noopLogf)
+	if extractCalls != 1 {
+		t.Fatalf("want 1 extract call after first parse, got %v", extractCalls)
+	}
+
+	processWatchedFile(cfg, fs, file, hashes, noopLogf)
+	if extractCalls != 1 {
+		t.Fatalf("want extraction skipped for unchanged content, got %v calls", extractCalls)
+	}
+
+	fs.files[file] = []byte("include <linux/types.h>\n\ndefine FOO 2\n")
+	processWatchedFile(cfg, fs, file, hashes, noopLogf)
+	if extractCalls != 2 {
+		t.Fatalf("want re-extraction after content changed, got %v calls", extractCalls)
+	}
+}
+
+func TestProcessWatchedFileDiffsAgainstMultiArchConstFile(t *testing.T) {
+	const (
+		file      = "sys/linux/foo.txt"
+		constPath = "sys/linux/foo_amd64.const"
+	)
+	fs := newMemFs(map[string][]byte{
+		file: []byte("include <linux/types.h>\n\ndefine FOO 1\n"),
+		constPath: SerializeConstsMulti(map[string]map[string]uint64{
+			"amd64": {"FOO": 1, "BAR": 2},
+		}),
+	})
+	cfg := &WatchConfig{
+		Archs: []string{"amd64"},
+		Fs:    fs,
+		Extract: func(file, arch string, info *ConstInfo) (map[string]uint64, error) {
+			// BAR moved, FOO stayed the same.
+			return map[string]uint64{"FOO": 1, "BAR": 3}, nil
+		},
+		ConstPath: func(file, arch string) string {
+			return constPath
+		},
+	}
+	var msgs []string
+	logf := func(format string, args ...interface{}) {
+		msgs = append(msgs, fmt.Sprintf(format, args...))
+	}
+	hashes := make(map[string]string)
+
+	processWatchedFile(cfg, fs, file, hashes, logf)
+
+	found := false
+	for _, msg := range msgs {
+		if strings.Contains(msg, "BAR changed: 2 -> 3") {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("expected a diff line reporting the prior BAR value from the multi-arch const file, got %v", msgs)
+	}
+}